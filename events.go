@@ -0,0 +1,178 @@
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is a single line of output, tagged with enough information
+// (Stream, Seq, Time) for a consumer to reconstruct the interleaving of
+// stdout and stderr without needing two separate LineInputCallback
+// closures.
+type Event struct {
+	Stream  int
+	Seq     uint64
+	Time    time.Time
+	Line    string
+	Payload int64
+}
+
+// EventSink receives Events as a command runs; see RunWithSink.
+type EventSink interface {
+	Write(Event)
+}
+
+// ChannelSink is an EventSink backed by a channel, for goroutine consumers.
+// Call Close once the producing command has finished.
+type ChannelSink struct {
+	C chan Event
+}
+
+// NewChannelSink creates a ChannelSink with the given channel buffer size.
+func NewChannelSink(buffer int) *ChannelSink {
+	return &ChannelSink{C: make(chan Event, buffer)}
+}
+
+func (this *ChannelSink) Write(e Event) {
+	this.C <- e
+}
+
+func (this *ChannelSink) Close() {
+	close(this.C)
+}
+
+// JSONLSink writes one JSON object per line to w, e.g. for streaming
+// progress from a subprocess to its own parent.
+type JSONLSink struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewJSONLSink creates a JSONLSink writing to w.
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{w: w}
+}
+
+func (this *JSONLSink) Write(e Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.w.Write(b)
+}
+
+// callbackEventSink adapts the legacy two-closure LineInputCallback API
+// onto EventSink, used by RunWithCallbacks to stay a thin wrapper around
+// RunWithSink's plumbing.
+type callbackEventSink struct {
+	stdoutCb, stderrCb LineInputCallback
+}
+
+func (this callbackEventSink) Write(e Event) {
+	switch e.Stream {
+	case STDOUT:
+		if this.stdoutCb != nil {
+			this.stdoutCb(e.Line, e.Payload)
+		}
+	case STDERR:
+		if this.stderrCb != nil {
+			this.stderrCb(e.Line, e.Payload)
+		}
+	}
+}
+
+// newEventCompositeWriter builds a CompositeWriter that reports each line to
+// sink instead of a plain LineInputCallback; RunWithCallbacks reaches its
+// callbacks through a callbackEventSink.
+func newEventCompositeWriter(t int, sink EventSink, seq *uint64, payload int64, keepBuffer bool) *CompositeWriter {
+	cw := CompositeWriter{Type: t}
+	cw.sink = sink
+	cw.seq = seq
+	cw.callbackPayload = payload
+	cw.keepBuffer = keepBuffer
+	cw.buffer = &simpleGrowingBuffer{}
+	return &cw
+}
+
+// attachCompositeWriters wires stdoutW/stderrW (either may be nil) into
+// whichever execution backend Begin() set up: a PTY merges stdout+stderr so
+// only stdoutW applies there, while native SSH and plain exec keep them
+// separate.
+func (this *CommandExecution) attachCompositeWriters(stdoutW, stderrW *CompositeWriter) {
+	if stdoutW != nil {
+		if stdoutW.keepBuffer {
+			stdoutW.buffer.MaxBytes = this.MaxStdoutBytes
+		}
+		stdoutW.tee = this.StdoutWriter
+	}
+	if stderrW != nil {
+		if stderrW.keepBuffer {
+			stderrW.buffer.MaxBytes = this.MaxStderrBytes
+		}
+		stderrW.tee = this.StderrWriter
+	}
+
+	switch {
+	case this.ptyHandle != nil:
+		if stdoutW != nil {
+			this.ptyWriter = stdoutW
+		}
+	case this.sshSession != nil:
+		if stdoutW != nil {
+			this.sshSession.Stdout = stdoutW
+		}
+		if stderrW != nil {
+			this.sshSession.Stderr = stderrW
+		}
+	default:
+		if stdoutW != nil {
+			this.WrappedCmd.Stdout = stdoutW
+		}
+		if stderrW != nil {
+			this.WrappedCmd.Stderr = stderrW
+		}
+	}
+}
+
+// RunWithSink behaves like RunWithCallbacks, but reports structured Events
+// (with stream, sequence number and timing) to sink instead of invoking a
+// pair of LineInputCallback closures.
+func (this *CommandExecution) RunWithSink(sink EventSink) error {
+	this.AutoReadStdout = false
+	this.AutoReadStderr = false
+
+	if err := this.Begin(); err != nil {
+		return err
+	}
+
+	var seq uint64
+	stdoutW := newEventCompositeWriter(STDOUT, sink, &seq, 0, true)
+	stderrW := newEventCompositeWriter(STDERR, sink, &seq, 0, true)
+	this.attachCompositeWriters(stdoutW, stderrW)
+
+	return this.Run()
+}
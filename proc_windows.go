@@ -0,0 +1,36 @@
+// +build windows
+
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows: there is no pgid equivalent, so
+// cancellation reaches only the started process, not its descendants.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup forcibly terminates the process right away. Windows
+// has no SIGTERM, so there is no graceful stage before the kill, and without
+// a job object the process's descendants are not terminated.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,146 @@
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// ptyHandle abstracts over the platform-specific pseudo-terminal master
+// (creack/pty on Unix, ConPTY on Windows): a single read/write stream
+// carrying the child's merged stdout+stderr, plus the ability to resize it.
+type ptyHandle interface {
+	io.ReadWriteCloser
+	Resize(rows, cols uint16) error
+}
+
+// startPty is implemented per-platform in pty_unix.go / pty_windows.go: it
+// starts cmd attached to a freshly allocated PTY of the given size and
+// returns its master end.
+
+func (self *CommandExecution) beginPty() error {
+	ctx := self.contextForExec()
+
+	cmd := exec.CommandContext(ctx, self.Command, self.Args...)
+	// no setProcessGroup here: on Unix startPty runs the child with Setsid,
+	// which already makes it a process group leader, and Setpgid on a
+	// session leader fails with EPERM
+	cmd.WaitDelay = self.killGraceOrDefault()
+	cmd.Cancel = func() error {
+		return terminateProcessGroup(cmd)
+	}
+
+	if self.Environment != nil {
+		cmd.Env = os.Environ()
+		for k, v := range self.Environment {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+
+	if self.LogExecution {
+		log.Printf("DEBUG: execute (pty) \"%s %s\"", self.Command, strings.Join(self.Args, " "))
+	}
+
+	handle, err := startPty(cmd, self.PtySize)
+	if err != nil {
+		return err
+	}
+
+	self.WrappedCmd = cmd
+	self.ptyHandle = handle
+	self.StdoutReader = handle
+	self.StderrReader = nil
+
+	if self.Stdin != nil {
+		go io.Copy(handle, self.Stdin)
+	}
+
+	return nil
+}
+
+func (self *CommandExecution) runPty() error {
+	if self.ptyHandle == nil {
+		if err := self.beginPty(); err != nil {
+			return err
+		}
+	}
+	if self.cancel != nil {
+		defer self.cancel()
+	}
+	defer self.ptyHandle.Close()
+
+	switch {
+	case self.ptyWriter != nil:
+		_, err := io.Copy(self.ptyWriter, self.ptyHandle)
+		// a PTY signals end-of-output by closing, which surfaces as an
+		// I/O error from the slave side; that is expected, not a failure
+		_ = err
+	case self.StdoutWriter != nil:
+		if _, err := io.Copy(self.StdoutWriter, self.ptyHandle); err != nil && !errors.Is(err, syscall.EIO) {
+			return err
+		}
+	default:
+		b, truncated, err := readAllBounded(self.ptyHandle, self.MaxStdoutBytes)
+		if err != nil && !errors.Is(err, syscall.EIO) {
+			return err
+		}
+		self.Stdout = b
+		self.Truncated = self.Truncated || truncated
+	}
+
+	err := self.WrappedCmd.Wait()
+
+	if cw, ok := self.ptyWriter.(*CompositeWriter); ok {
+		cw.Finalize()
+		if cw.keepBuffer {
+			self.Stdout = cw.ToString()
+			self.Truncated = self.Truncated || cw.buffer.Truncated
+			cw.buffer.Reset()
+		}
+	}
+
+	if err != nil && self.ctx != nil && self.ctx.Err() != nil {
+		// canceled or timed out: distinguish this from a plain non-zero
+		// exit code by leaving ExitCode at -1 and wrapping ctx.Err()
+		self.ExitCode = -1
+		return fmt.Errorf("command '%s %v' did not complete: %w", self.Command, self.Args, self.ctx.Err())
+	}
+
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				self.ExitCode = status.ExitStatus()
+			} else {
+				panic("cannot retrieve exit code")
+			}
+			return nil
+		}
+		return err
+	}
+
+	self.ExitCode = 0
+	return nil
+}
@@ -0,0 +1,54 @@
+// +build !windows
+
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// unixPty wraps the *os.File master returned by creack/pty so it satisfies
+// ptyHandle.
+type unixPty struct {
+	*os.File
+}
+
+func (p unixPty) Resize(rows, cols uint16) error {
+	return pty.Setsize(p.File, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+func startPty(cmd *exec.Cmd, size PtySize) (ptyHandle, error) {
+	var master *os.File
+	var err error
+
+	if size.Rows != 0 || size.Cols != 0 {
+		master, err = pty.StartWithSize(cmd, &pty.Winsize{Rows: size.Rows, Cols: size.Cols})
+	} else {
+		master, err = pty.Start(cmd)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return unixPty{master}, nil
+}
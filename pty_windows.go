@@ -0,0 +1,197 @@
+// +build windows
+
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// conPty wraps a Windows 10+ ConPTY (pseudo console), feeding it through the
+// matching pair of anonymous pipes as a single read/write stream.
+type conPty struct {
+	console windows.Handle
+	inW     *os.File // write end given to the child's stdin
+	outR    *os.File // read end receiving the child's stdout+stderr
+
+	closeOnce sync.Once
+}
+
+func (c *conPty) Read(p []byte) (int, error)  { return c.outR.Read(p) }
+func (c *conPty) Write(p []byte) (int, error) { return c.inW.Write(p) }
+
+func (c *conPty) Resize(rows, cols uint16) error {
+	size := uintptr(cols) | uintptr(rows)<<16
+	if hr := resizePseudoConsole(c.console, size); hr != 0 {
+		return fmt.Errorf("ResizePseudoConsole failed with HRESULT 0x%x", hr)
+	}
+	return nil
+}
+
+func (c *conPty) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		closePseudoConsole(c.console)
+		err = c.inW.Close()
+		if e := c.outR.Close(); err == nil {
+			err = e
+		}
+	})
+	return err
+}
+
+func startPty(cmd *exec.Cmd, size PtySize) (ptyHandle, error) {
+	rows, cols := size.Rows, size.Cols
+	if rows == 0 {
+		rows = 24
+	}
+	if cols == 0 {
+		cols = 80
+	}
+
+	// ptyIn: child reads its stdin from here, we write into ptyInW
+	ptyInR, ptyInW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	// ptyOut: child writes its stdout+stderr here, we read from ptyOutR
+	ptyOutR, ptyOutW, err := os.Pipe()
+	if err != nil {
+		ptyInR.Close()
+		ptyInW.Close()
+		return nil, err
+	}
+
+	consoleSize := uintptr(cols) | uintptr(rows)<<16
+	var hPC windows.Handle
+	if hr := createPseudoConsole(consoleSize, windows.Handle(ptyInR.Fd()), windows.Handle(ptyOutW.Fd()), &hPC); hr != 0 {
+		ptyInR.Close()
+		ptyInW.Close()
+		ptyOutR.Close()
+		ptyOutW.Close()
+		return nil, fmt.Errorf("CreatePseudoConsole failed with HRESULT 0x%x", hr)
+	}
+
+	cmdLine := windows.EscapeArg(cmd.Path)
+	for _, a := range cmd.Args[1:] {
+		cmdLine += " " + windows.EscapeArg(a)
+	}
+
+	pid, err := spawnWithPseudoConsole(hPC, cmdLine, cmd.Env)
+
+	// the console-side handles are now owned by the child / ConPTY
+	ptyInR.Close()
+	ptyOutW.Close()
+
+	if err != nil {
+		closePseudoConsole(hPC)
+		ptyInW.Close()
+		ptyOutR.Close()
+		return nil, err
+	}
+
+	cmd.Process, err = os.FindProcess(pid)
+	if err != nil {
+		closePseudoConsole(hPC)
+		ptyInW.Close()
+		ptyOutR.Close()
+		return nil, err
+	}
+
+	return &conPty{console: hPC, inW: ptyInW, outR: ptyOutR}, nil
+}
+
+var (
+	kernel32                = windows.NewLazySystemDLL("kernel32.dll")
+	procCreatePseudoConsole = kernel32.NewProc("CreatePseudoConsole")
+	procResizePseudoConsole = kernel32.NewProc("ResizePseudoConsole")
+	procClosePseudoConsole  = kernel32.NewProc("ClosePseudoConsole")
+)
+
+func createPseudoConsole(size uintptr, in, out windows.Handle, hpc *windows.Handle) uintptr {
+	hr, _, _ := procCreatePseudoConsole.Call(size, uintptr(in), uintptr(out), 0, uintptr(unsafe.Pointer(hpc)))
+	return hr
+}
+
+func resizePseudoConsole(hpc windows.Handle, size uintptr) uintptr {
+	hr, _, _ := procResizePseudoConsole.Call(uintptr(hpc), size)
+	return hr
+}
+
+func closePseudoConsole(hpc windows.Handle) {
+	procClosePseudoConsole.Call(uintptr(hpc))
+}
+
+// spawnWithPseudoConsole creates a process attached to hpc via the
+// PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE extended startup info attribute, and
+// returns its process ID.
+func spawnWithPseudoConsole(hpc windows.Handle, cmdLine string, env []string) (int, error) {
+	const procThreadAttributePseudoconsole = 0x00020016
+
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return 0, err
+	}
+	defer attrs.Delete()
+
+	if err := attrs.Update(procThreadAttributePseudoconsole, unsafe.Pointer(&hpc), unsafe.Sizeof(hpc)); err != nil {
+		return 0, err
+	}
+
+	si := &windows.StartupInfoEx{
+		ProcThreadAttributeList: attrs.List(),
+	}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+
+	var pi windows.ProcessInformation
+
+	argv, err := windows.UTF16PtrFromString(cmdLine)
+	if err != nil {
+		return 0, err
+	}
+
+	var envPtr *uint16
+	if len(env) > 0 {
+		envPtr, err = windows.UTF16PtrFromString(strings.Join(env, "\x00") + "\x00")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = windows.CreateProcess(
+		nil, argv, nil, nil, false,
+		windows.EXTENDED_STARTUPINFO_PRESENT|windows.CREATE_UNICODE_ENVIRONMENT,
+		envPtr, nil, &si.StartupInfo, &pi)
+	if err != nil {
+		return 0, err
+	}
+
+	windows.CloseHandle(pi.Thread)
+	windows.CloseHandle(pi.Process)
+
+	return int(pi.ProcessId), nil
+}
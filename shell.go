@@ -20,17 +20,29 @@ package shell
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
+// defaultKillGrace is used as KillGrace when a context-bound
+// CommandExecution doesn't set one explicitly.
+const defaultKillGrace = 5 * time.Second
+
+// defaultMaxBufferBytes is used as MaxStdoutBytes/MaxStderrBytes by New,
+// bounding the in-memory buffer kept for a chatty command.
+const defaultMaxBufferBytes = 16 * 1024 * 1024
+
 const (
 	STDOUT = 1
 	STDERR = 2
@@ -42,6 +54,11 @@ type simpleGrowingBuffer struct {
 	sync.Mutex
 	byteBuffer        []byte
 	LastNewlineOffset int
+
+	// MaxBytes, when non-zero, bounds byteBuffer: once exceeded, the
+	// oldest bytes are dropped and Truncated is set.
+	MaxBytes  int64
+	Truncated bool
 }
 
 type CompositeWriter struct {
@@ -51,6 +68,26 @@ type CompositeWriter struct {
 	keepBuffer      bool // keep full buffer in memory
 	callback        LineInputCallback
 	callbackPayload int64
+
+	// sink/seq are set by newEventCompositeWriter (used by RunWithSink and,
+	// as an adapter, by RunWithCallbacks) to additionally emit an Event per
+	// line; seq is shared across the stdout/stderr writers of one
+	// CommandExecution so consumers can reconstruct interleaving.
+	sink EventSink
+	seq  *uint64
+
+	// tee, when set, additionally receives every raw byte slice written,
+	// independently of the line-splitting/buffering above; used to let a
+	// caller-supplied StdoutWriter/StderrWriter keep working alongside
+	// LineInputCallback/EventSink consumers.
+	tee io.Writer
+}
+
+// PtySize describes the terminal dimensions to allocate for a
+// CommandExecution running with UsePty set.
+type PtySize struct {
+	Rows uint16
+	Cols uint16
 }
 
 type CommandExecution struct {
@@ -62,6 +99,39 @@ type CommandExecution struct {
 	AutoReadStdout bool
 	AutoReadStderr bool
 
+	// UsePty runs the command attached to a pseudo-terminal instead of
+	// plain pipes, so isatty checks (sudo prompts, progress bars, REPLs)
+	// behave as if run interactively. Stdout carries the merged
+	// stdout+stderr stream, since a PTY does not keep them separate.
+	UsePty  bool
+	PtySize PtySize
+	// Stdin, when set and UsePty is true, is copied into the PTY as
+	// keystrokes.
+	Stdin io.Reader
+
+	// Timeout, when non-zero, is applied as a context.WithTimeout around
+	// the command; see also RunContext for caller-supplied contexts.
+	Timeout time.Duration
+	// KillGrace bounds how long a canceled/timed-out command is given to
+	// exit after SIGTERM before it is sent SIGKILL. Defaults to
+	// defaultKillGrace when zero.
+	KillGrace time.Duration
+
+	// MaxStdoutBytes/MaxStderrBytes bound how much of a retained
+	// (keepBuffer) CompositeWriter buffer stays in memory; 0 means
+	// unlimited. New defaults both to defaultMaxBufferBytes.
+	MaxStdoutBytes int64
+	MaxStderrBytes int64
+
+	// StdoutWriter/StderrWriter, when set, make Run stream into them via
+	// io.Copy instead of collecting Stdout/Stderr as an in-memory string.
+	// With a line callback or sink they receive a raw copy as a tee; the
+	// matching Stdout/Stderr is then still collected whenever that
+	// writer's buffer is kept (keepStdout/keepStderr, always for
+	// RunWithSink).
+	StdoutWriter io.Writer
+	StderrWriter io.Writer
+
 	// result fields
 	WrappedCmd   *exec.Cmd
 	StdoutReader io.ReadCloser
@@ -69,6 +139,25 @@ type CommandExecution struct {
 	Stdout       string
 	Stderr       string
 	ExitCode     int
+	// Truncated is set once MaxStdoutBytes/MaxStderrBytes caused older
+	// buffered output to be discarded.
+	Truncated bool
+
+	// set by NewSshNative; when non-nil, Begin/Run connect via
+	// golang.org/x/crypto/ssh instead of forking a local process
+	sshHost    string
+	sshConfig  *SshConfig
+	sshClient  *ssh.Client
+	sshSession *ssh.Session
+
+	// set by beginPty; when non-nil, Run reads/writes through the PTY
+	// master instead of plain exec.Cmd pipes
+	ptyHandle ptyHandle
+	ptyWriter io.Writer
+
+	// set by RunContext/RunWithCallbacksContext, or derived from Timeout
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 var (
@@ -112,12 +201,48 @@ func (this *simpleGrowingBuffer) IncrementOffset(delta int) {
 
 func (this *simpleGrowingBuffer) Append(p []byte) {
 	this.byteBuffer = append(this.byteBuffer, p...)
+
+	if this.MaxBytes > 0 && int64(len(this.byteBuffer)) > this.MaxBytes {
+		discard := int64(len(this.byteBuffer)) - this.MaxBytes
+
+		this.byteBuffer = this.byteBuffer[discard:]
+		this.LastNewlineOffset -= int(discard)
+		if this.LastNewlineOffset < 0 {
+			this.LastNewlineOffset = 0
+		}
+		this.Truncated = true
+	}
 }
 
 func (this *simpleGrowingBuffer) ToString() string {
 	return string(this.byteBuffer)
 }
 
+// readAllBounded reads r to completion, keeping only the most recent
+// maxBytes (0 means unlimited) via the same discard-oldest logic a
+// keepBuffer CompositeWriter applies, and reports whether anything was
+// discarded. It exists for Run()'s default path, where neither a
+// StdoutWriter/StderrWriter nor a callback/sink is set up to bound things.
+func readAllBounded(r io.Reader, maxBytes int64) (string, bool, error) {
+	buf := &simpleGrowingBuffer{MaxBytes: maxBytes}
+
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			buf.Append(chunk[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return buf.ToString(), buf.Truncated, err
+		}
+	}
+
+	return buf.ToString(), buf.Truncated, nil
+}
+
 // return full buffer - only valid in case keepBuffer is true
 func (this CompositeWriter) ToString() string {
 	if this.keepBuffer == false {
@@ -127,15 +252,36 @@ func (this CompositeWriter) ToString() string {
 	return this.buffer.ToString()
 }
 
+// emit reports line to whichever of callback/sink is set; at least one
+// caller-visible sink is assumed to be present when this is reached.
+func (this CompositeWriter) emit(line string) {
+	if this.callback != nil {
+		this.callback(line, this.callbackPayload)
+	}
+	if this.sink != nil {
+		this.sink.Write(Event{
+			Stream:  this.Type,
+			Seq:     atomic.AddUint64(this.seq, 1),
+			Time:    time.Now(),
+			Line:    line,
+			Payload: this.callbackPayload,
+		})
+	}
+}
+
 func (this CompositeWriter) Write(p []byte) (n int, err error) {
+	if this.tee != nil {
+		this.tee.Write(p)
+	}
+
 	this.buffer.Lock()
 	defer this.buffer.Unlock()
 
 	// grow internal buffer
 	this.buffer.Append(p)
 
-	// no newline-tracking when no callback is present
-	if this.callback != nil {
+	// no newline-tracking when neither a callback nor a sink is present
+	if this.callback != nil || this.sink != nil {
 		foundSmth := false
 		pos := bytes.IndexByte(this.buffer.Slice(), '\n')
 		for pos != -1 {
@@ -143,7 +289,7 @@ func (this CompositeWriter) Write(p []byte) (n int, err error) {
 			// emit line
 			line := string(this.buffer.SliceNext(pos))
 
-			this.callback(line, this.callbackPayload)
+			this.emit(line)
 
 			this.buffer.IncrementOffset(pos + 1)
 
@@ -163,13 +309,13 @@ func (this CompositeWriter) Finalize() {
 	this.buffer.Lock()
 	defer this.buffer.Unlock()
 
-	// no newline-tracking when no callback is present
-	if this.callback != nil {
+	// no newline-tracking when neither a callback nor a sink is present
+	if this.callback != nil || this.sink != nil {
 		pos := this.buffer.SliceLength()
 		if pos > 0 {
 			// emit line
 			line := string(this.buffer.SliceNext(pos))
-			this.callback(line, this.callbackPayload)
+			this.emit(line)
 
 			if !this.keepBuffer {
 				// reset each time a new line is extracted
@@ -193,6 +339,8 @@ func New(command string, args ...string) *CommandExecution {
 		Stdout:         "-- stdout: this command has never been executed --",
 		Stderr:         "-- stderr: this command has never been executed --",
 		ExitCode:       -1,
+		MaxStdoutBytes: defaultMaxBufferBytes,
+		MaxStderrBytes: defaultMaxBufferBytes,
 	}
 }
 
@@ -200,9 +348,50 @@ func (self *CommandExecution) GetFormattedError() error {
 	return fmt.Errorf("Process of command '%s %v' returned exit code %d, follows stdout and stderr\n%s\n%s", self.Command, self.Args, self.ExitCode, self.Stdout, self.Stderr)
 }
 
+// contextForExec resolves the context.Context a command should run under:
+// self.ctx as set via RunContext/RunWithCallbacksContext (or
+// context.Background() when unset), further bounded by Timeout when that is
+// non-zero. It stores the result back on self so Run()
+// (or its PTY/SSH equivalents) can later distinguish a cancellation from a
+// plain non-zero exit code. Shared by every backend Begin() may dispatch to.
+func (self *CommandExecution) contextForExec() context.Context {
+	ctx := self.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if self.Timeout > 0 {
+		ctx, self.cancel = context.WithTimeout(ctx, self.Timeout)
+	}
+	self.ctx = ctx
+	return ctx
+}
+
+// killGraceOrDefault returns self.KillGrace, or defaultKillGrace when unset.
+func (self *CommandExecution) killGraceOrDefault() time.Duration {
+	if self.KillGrace > 0 {
+		return self.KillGrace
+	}
+	return defaultKillGrace
+}
+
 func (self *CommandExecution) Begin() error {
+	if self.sshConfig != nil {
+		return self.beginNativeSsh()
+	}
+	if self.UsePty {
+		return self.beginPty()
+	}
+
+	ctx := self.contextForExec()
+
 	// create the native Go execution structure
-	cmd := exec.Command(self.Command, self.Args...)
+	cmd := exec.CommandContext(ctx, self.Command, self.Args...)
+	setProcessGroup(cmd)
+
+	cmd.WaitDelay = self.killGraceOrDefault()
+	cmd.Cancel = func() error {
+		return terminateProcessGroup(cmd)
+	}
 
 	if self.AutoReadStdout {
 		stdout, err := cmd.StdoutPipe()
@@ -241,6 +430,13 @@ func (self *CommandExecution) Begin() error {
 }
 
 func (self *CommandExecution) Run() error {
+	if self.sshConfig != nil {
+		return self.runNativeSsh()
+	}
+	if self.UsePty {
+		return self.runPty()
+	}
+
 	// auto-initialization
 	if self.WrappedCmd == nil {
 		err := self.Begin()
@@ -248,6 +444,9 @@ func (self *CommandExecution) Run() error {
 			return err
 		}
 	}
+	if self.cancel != nil {
+		defer self.cancel()
+	}
 
 	// allow process to have been started externally
 	if self.WrappedCmd.Process == nil {
@@ -257,22 +456,34 @@ func (self *CommandExecution) Run() error {
 		}
 	}
 
-	var bytes []byte
-
 	if self.StdoutReader != nil {
-		var err error
-		if bytes, err = ioutil.ReadAll(self.StdoutReader); err != nil {
-			return err
+		if self.StdoutWriter != nil {
+			if _, err := io.Copy(self.StdoutWriter, self.StdoutReader); err != nil {
+				return err
+			}
+		} else {
+			b, truncated, err := readAllBounded(self.StdoutReader, self.MaxStdoutBytes)
+			if err != nil {
+				return err
+			}
+			self.Stdout = b
+			self.Truncated = self.Truncated || truncated
 		}
-		self.Stdout = string(bytes)
 	}
 
 	if self.StderrReader != nil {
-		var err error
-		if bytes, err = ioutil.ReadAll(self.StderrReader); err != nil {
-			return err
+		if self.StderrWriter != nil {
+			if _, err := io.Copy(self.StderrWriter, self.StderrReader); err != nil {
+				return err
+			}
+		} else {
+			b, truncated, err := readAllBounded(self.StderrReader, self.MaxStderrBytes)
+			if err != nil {
+				return err
+			}
+			self.Stderr = b
+			self.Truncated = self.Truncated || truncated
 		}
-		self.Stderr = string(bytes)
 	}
 
 	err := self.WrappedCmd.Wait()
@@ -286,6 +497,7 @@ func (self *CommandExecution) Run() error {
 		// grab buffer
 		if cw.keepBuffer {
 			self.Stdout = cw.ToString()
+			self.Truncated = self.Truncated || cw.buffer.Truncated
 			// allow GC of the attached byte buffer
 			cw.buffer.Reset()
 		}
@@ -299,11 +511,19 @@ func (self *CommandExecution) Run() error {
 		// grab buffer
 		if cw.keepBuffer {
 			self.Stderr = cw.ToString()
+			self.Truncated = self.Truncated || cw.buffer.Truncated
 			// allow GC of the attached byte buffer
 			cw.buffer.Reset()
 		}
 	}
 	
+	if err != nil && self.ctx != nil && self.ctx.Err() != nil {
+		// canceled or timed out: distinguish this from a plain non-zero
+		// exit code by leaving ExitCode at -1 and wrapping ctx.Err()
+		self.ExitCode = -1
+		return fmt.Errorf("command '%s %v' did not complete: %w", self.Command, self.Args, self.ctx.Err())
+	}
+
 	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			// The program has exited with an exit code != 0
@@ -331,6 +551,14 @@ func (self *CommandExecution) Run() error {
 	return nil
 }
 
+// RunContext behaves like Run, but the command is bound to ctx: canceling
+// ctx (or it timing out) terminates the process instead of leaving Run
+// blocked until completion.
+func (self *CommandExecution) RunContext(ctx context.Context) error {
+	self.ctx = ctx
+	return self.Run()
+}
+
 func (this *CommandExecution) RunWithCallbacks(stdoutCb, stderrCb LineInputCallback, stdoutPayload, stderrPayload int64, keepStdout, keepStderr bool) error {
 	if stdoutCb != nil {
 		this.AutoReadStdout = false
@@ -345,16 +573,44 @@ func (this *CommandExecution) RunWithCallbacks(stdoutCb, stderrCb LineInputCallb
 		return err
 	}
 
+	// this is a thin adapter over the Event/EventSink API: each line still
+	// goes through a CompositeWriter, just one that also knows how to
+	// report back to a plain LineInputCallback
+	sink := callbackEventSink{stdoutCb: stdoutCb, stderrCb: stderrCb}
+	var seq uint64
+
+	var stdoutW, stderrW *CompositeWriter
 	if stdoutCb != nil {
-		this.WrappedCmd.Stdout = NewCompositeWriter(STDOUT, stdoutCb, stdoutPayload, keepStdout)
+		stdoutW = newEventCompositeWriter(STDOUT, sink, &seq, stdoutPayload, keepStdout)
 	}
 	if stderrCb != nil {
-		this.WrappedCmd.Stderr = NewCompositeWriter(STDERR, stderrCb, stderrPayload, keepStderr)
+		stderrW = newEventCompositeWriter(STDERR, sink, &seq, stderrPayload, keepStderr)
 	}
+	// a PTY merges stdout+stderr, so only the stdout writer applies there
+	this.attachCompositeWriters(stdoutW, stderrW)
 
 	return this.Run()
 }
 
+// RunWithCallbacksContext behaves like RunWithCallbacks, but the command is
+// bound to ctx: canceling ctx (or it timing out) terminates the process.
+func (this *CommandExecution) RunWithCallbacksContext(ctx context.Context, stdoutCb, stderrCb LineInputCallback, stdoutPayload, stderrPayload int64, keepStdout, keepStderr bool) error {
+	this.ctx = ctx
+	return this.RunWithCallbacks(stdoutCb, stderrCb, stdoutPayload, stderrPayload, keepStdout, keepStderr)
+}
+
+// Resize propagates new terminal dimensions to a running PTY-backed
+// command, e.g. when forwarding SIGWINCH from the caller's own terminal
+// (see moby/term.MakeRaw). It is an error to call this when UsePty is false
+// or before the command has started.
+func (self *CommandExecution) Resize(rows, cols uint16) error {
+	if self.ptyHandle == nil {
+		return fmt.Errorf("Resize called on a CommandExecution that is not running with UsePty")
+	}
+
+	return self.ptyHandle.Resize(rows, cols)
+}
+
 ///
 /// following logic only affects SSH
 ///
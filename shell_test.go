@@ -19,8 +19,12 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package shell
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func theCallback(line string, payload int64) {
@@ -83,3 +87,82 @@ func TestCallbacks(t *testing.T) {
 
 	t.Logf("successfully executed with exit value = %d", cmd.ExitCode)
 }
+
+func TestMaxStdoutBytes(t *testing.T) {
+	cmd := New("sh", "-c", "for i in $(seq 1 2000); do echo -n 0123456789; done")
+	cmd.MaxStdoutBytes = 1024
+
+	err := cmd.RunWithCallbacks(theCallback, nil, 0, 0, true, false)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if !cmd.Truncated {
+		t.Logf("expected Truncated to be set")
+		t.FailNow()
+	}
+
+	if len(cmd.Stdout) > 1024 {
+		t.Logf("retained buffer exceeds MaxStdoutBytes: %d bytes", len(cmd.Stdout))
+		t.FailNow()
+	}
+}
+
+func TestMaxStdoutBytesPlainRun(t *testing.T) {
+	cmd := New("sh", "-c", "for i in $(seq 1 2000); do echo -n 0123456789; done")
+	cmd.MaxStdoutBytes = 1024
+
+	if err := cmd.Run(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if !cmd.Truncated {
+		t.Logf("expected Truncated to be set")
+		t.FailNow()
+	}
+
+	if len(cmd.Stdout) > 1024 {
+		t.Logf("retained buffer exceeds MaxStdoutBytes: %d bytes", len(cmd.Stdout))
+		t.FailNow()
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cmd := New("sleep", "5")
+	cmd.Timeout = 50 * time.Millisecond
+
+	err := cmd.Run()
+	if err == nil {
+		t.Logf("expected an error from a timed-out command")
+		t.FailNow()
+	}
+
+	if cmd.ExitCode != -1 {
+		t.Logf("expected ExitCode -1, got %d", cmd.ExitCode)
+		t.FailNow()
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Logf("expected error to wrap context.DeadlineExceeded, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestStdoutWriter(t *testing.T) {
+	cmd := New("echo", "hello")
+
+	var buf bytes.Buffer
+	cmd.StdoutWriter = &buf
+
+	if err := cmd.Run(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if buf.String() != "hello\n" {
+		t.Logf("stdout writer = %#v", buf.String())
+		t.FailNow()
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// NewFromString tokenizes cmdline with (a subset of) POSIX shell word
+// splitting rules, following the behaviour of anmitsu/go-shlex, and builds
+// a CommandExecution out of the resulting argv - no "sh -c" subshell
+// required. Supported: single/double-quoted words, backslash escapes,
+// "#" line comments and $VAR / ${VAR} expansion, resolved against
+// environment (falling back to os.Getenv when a name isn't present there,
+// or when environment is omitted entirely). Pipelines, redirections and
+// &&/|| are NOT interpreted; callers who need those can still fall back to
+// New("sh", "-c", cmdline).
+//
+// environment is variadic only so existing call sites that don't need it
+// can omit it; passing more than one map is an error.
+func NewFromString(cmdline string, environment ...map[string]string) (*CommandExecution, error) {
+	env, err := soleEnvironment(environment)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := tokenize(cmdline, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("NewFromString: empty command line")
+	}
+
+	cmd := New(args[0], args[1:]...)
+	cmd.Environment = env
+	return cmd, nil
+}
+
+// NewSshFromString tokenizes cmdline locally like NewFromString (expanding
+// $VAR/${VAR} against environment, see there), then single-quotes (with
+// "'\''" escaping) each resulting argument before handing it to NewSsh, so
+// the local parse reproduces the same argv on the remote shell instead of
+// being re-split by it. environment only affects local expansion - it is
+// not the remote command's environment, which NewSsh has no way to set.
+func NewSshFromString(host, cmdline string, environment ...map[string]string) (*CommandExecution, error) {
+	env, err := soleEnvironment(environment)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := tokenize(cmdline, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("NewSshFromString: empty command line")
+	}
+
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+
+	return NewSsh(host, quoted...), nil
+}
+
+// soleEnvironment extracts the at-most-one map a NewFromString/
+// NewSshFromString caller may have passed through their variadic
+// environment parameter.
+func soleEnvironment(environment []map[string]string) (map[string]string, error) {
+	switch len(environment) {
+	case 0:
+		return nil, nil
+	case 1:
+		return environment[0], nil
+	default:
+		return nil, fmt.Errorf("at most one environment map is accepted, got %d", len(environment))
+	}
+}
+
+// shellQuote wraps s in single quotes suitable for a POSIX shell, escaping
+// any single quote already in s as '\''.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// tokenize splits cmdline into argv, expanding $VAR/${VAR} references and
+// honoring quoting/escaping as described on NewFromString. environment is
+// variadic only so call sites that don't need it can omit it, mirroring
+// NewFromString; passing more than one map is an error. It returns an
+// error if a quote is left unclosed.
+func tokenize(cmdline string, environment ...map[string]string) ([]string, error) {
+	env, err := soleEnvironment(environment)
+	if err != nil {
+		return nil, err
+	}
+	const (
+		unquoted = iota
+		singleQuoted
+		doubleQuoted
+	)
+
+	var args []string
+	var cur strings.Builder
+	haveToken := false
+	quote := unquoted
+
+	runes := []rune(cmdline)
+	i := 0
+	for i < len(runes) {
+		c := runes[i]
+
+		if quote == unquoted && c == '#' && !haveToken {
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		}
+
+		switch quote {
+		case singleQuoted:
+			if c == '\'' {
+				quote = unquoted
+			} else {
+				cur.WriteRune(c)
+			}
+			i++
+			continue
+
+		case doubleQuoted:
+			switch {
+			case c == '"':
+				quote = unquoted
+				i++
+			case c == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`, runes[i+1]):
+				cur.WriteRune(runes[i+1])
+				i += 2
+			case c == '$':
+				value, consumed := expandVar(runes[i:], env)
+				cur.WriteString(value)
+				i += consumed
+			default:
+				cur.WriteRune(c)
+				i++
+			}
+			continue
+		}
+
+		// quote == unquoted
+		switch {
+		case c == '\'':
+			quote = singleQuoted
+			haveToken = true
+			i++
+		case c == '"':
+			quote = doubleQuoted
+			haveToken = true
+			i++
+		case c == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("tokenize: trailing backslash in %q", cmdline)
+			}
+			cur.WriteRune(runes[i+1])
+			haveToken = true
+			i += 2
+		case c == '$':
+			value, consumed := expandVar(runes[i:], env)
+			cur.WriteString(value)
+			haveToken = true
+			i += consumed
+		case c == ' ' || c == '\t' || c == '\n':
+			if haveToken {
+				args = append(args, cur.String())
+				cur.Reset()
+				haveToken = false
+			}
+			i++
+		default:
+			cur.WriteRune(c)
+			haveToken = true
+			i++
+		}
+	}
+
+	if quote != unquoted {
+		return nil, fmt.Errorf("tokenize: unclosed quote in %q", cmdline)
+	}
+
+	if haveToken {
+		args = append(args, cur.String())
+	}
+
+	return args, nil
+}
+
+// expandVar expands the $VAR or ${VAR} reference starting at runes[0] (which
+// must be '$'), returning its value and the number of runes consumed. An
+// unrecognized reference is left as a literal "$". environment, when
+// non-nil, is consulted before os.Getenv.
+func expandVar(runes []rune, environment map[string]string) (string, int) {
+	if len(runes) < 2 {
+		return "$", 1
+	}
+
+	if runes[1] == '{' {
+		for j := 2; j < len(runes); j++ {
+			if runes[j] == '}' {
+				return lookupEnv(environment, string(runes[2:j])), j + 1
+			}
+		}
+		return "$", 1
+	}
+
+	j := 1
+	for j < len(runes) && isVarNameRune(runes[j], j == 1) {
+		j++
+	}
+	if j == 1 {
+		return "$", 1
+	}
+
+	return lookupEnv(environment, string(runes[1:j])), j
+}
+
+// lookupEnv resolves name against environment first, falling back to
+// os.Getenv when environment is nil or doesn't have an entry for name.
+func lookupEnv(environment map[string]string, name string) string {
+	if v, ok := environment[name]; ok {
+		return v
+	}
+	return os.Getenv(name)
+}
+
+func isVarNameRune(r rune, first bool) bool {
+	switch {
+	case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return true
+	case r >= '0' && r <= '9':
+		return !first
+	default:
+		return false
+	}
+}
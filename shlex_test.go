@@ -0,0 +1,108 @@
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	os.Setenv("LIBSHELL_TEST_VAR", "world")
+
+	cases := []struct {
+		in       string
+		expected []string
+	}{
+		{`echo hello`, []string{"echo", "hello"}},
+		{`echo "hello world"`, []string{"echo", "hello world"}},
+		{`echo 'hello world'`, []string{"echo", "hello world"}},
+		{`echo hello\ world`, []string{"echo", "hello world"}},
+		{`echo $LIBSHELL_TEST_VAR`, []string{"echo", "world"}},
+		{`echo ${LIBSHELL_TEST_VAR}!`, []string{"echo", "world!"}},
+		{`echo '$LIBSHELL_TEST_VAR'`, []string{"echo", "$LIBSHELL_TEST_VAR"}},
+		{"echo hello # a comment", []string{"echo", "hello"}},
+	}
+
+	for _, c := range cases {
+		args, err := tokenize(c.in)
+		if err != nil {
+			t.Errorf("tokenize(%q) returned error: %v", c.in, err)
+			continue
+		}
+
+		if len(args) != len(c.expected) {
+			t.Errorf("tokenize(%q) = %#v, expected %#v", c.in, args, c.expected)
+			continue
+		}
+
+		for i := range args {
+			if args[i] != c.expected[i] {
+				t.Errorf("tokenize(%q) = %#v, expected %#v", c.in, args, c.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestTokenizeUnclosedQuote(t *testing.T) {
+	if _, err := tokenize(`echo "unterminated`); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestTokenizeWithEnvironment(t *testing.T) {
+	os.Setenv("LIBSHELL_TEST_VAR", "process")
+
+	env := map[string]string{"LIBSHELL_TEST_VAR": "override", "ONLY_IN_MAP": "mapped"}
+
+	args, err := tokenize(`echo $LIBSHELL_TEST_VAR ${ONLY_IN_MAP}`, env)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := []string{"echo", "override", "mapped"}
+	if len(args) != len(expected) {
+		t.Fatalf("tokenize() = %#v, expected %#v", args, expected)
+	}
+	for i := range args {
+		if args[i] != expected[i] {
+			t.Fatalf("tokenize() = %#v, expected %#v", args, expected)
+		}
+	}
+}
+
+func TestNewFromString(t *testing.T) {
+	cmd, err := NewFromString("echo hello world")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if err := cmd.Run(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if cmd.Stdout != "hello world\n" {
+		t.Logf("stdout = %#v", cmd.Stdout)
+		t.FailNow()
+	}
+}
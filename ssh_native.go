@@ -0,0 +1,388 @@
+/*
+ * libshell v0.1.0 - Feature-rich shell library for Go systems integration projects
+ * Copyright (C) 2014 gdm85 - https://github.com/gdm85/go-libshell/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ioNopCloser adapts an io.Reader (such as ssh.Session's pipes) to the
+// io.ReadCloser expected by CommandExecution.StdoutReader/StderrReader.
+type ioNopCloser struct {
+	io.Reader
+}
+
+func (ioNopCloser) Close() error { return nil }
+
+// SshConfig holds the options for a native SSH connection opened via
+// golang.org/x/crypto/ssh, as used by NewSshNative. It is the portable
+// alternative to forking the system ssh binary (see NewSsh).
+type SshConfig struct {
+	User string
+	Port int // defaults to 22 when zero
+
+	// Auth holds the methods tried in order; at least one must be set,
+	// see PasswordAuth, PrivateKeyAuth and AgentAuth.
+	Auth []ssh.AuthMethod
+
+	// HostKeyCallback verifies the remote host key; use
+	// KnownHostsCallback to validate against an OpenSSH known_hosts file.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Timeout bounds the TCP dial and handshake; zero means no timeout.
+	Timeout time.Duration
+}
+
+// PasswordAuth is a convenience wrapper around ssh.Password.
+func PasswordAuth(password string) ssh.AuthMethod {
+	return ssh.Password(password)
+}
+
+// PrivateKeyAuth parses a PEM-encoded private key (optionally encrypted
+// with passphrase, which may be empty) and returns an ssh.AuthMethod.
+func PrivateKeyAuth(pemBytes []byte, passphrase string) (ssh.AuthMethod, error) {
+	var signer ssh.Signer
+	var err error
+
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.PublicKeys(signer), nil
+}
+
+// AgentAuth dials the ssh-agent referenced by the SSH_AUTH_SOCK environment
+// variable and returns an ssh.AuthMethod backed by it.
+func AgentAuth() (ssh.AuthMethod, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set, no ssh-agent to connect to")
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), nil
+}
+
+// KnownHostsCallback returns a HostKeyCallback that validates against the
+// OpenSSH-format known_hosts file at path, creating it if it does not exist
+// yet. Hosts not already present are trusted on first use and appended to
+// the file, mirroring what an interactive ssh client would do if the user
+// always answered "yes".
+func KnownHostsCallback(path string) (ssh.HostKeyCallback, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) != 0 {
+			// either an unrelated error, or a changed key: never auto-trust that
+			return err
+		}
+
+		// host is not yet known: trust it and persist for next time
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = f.WriteString(knownhosts.Line([]string{hostname}, key) + "\n")
+		return err
+	}, nil
+}
+
+// applyExtraSshOptions maps the subset of ExtraSshOptions ("-o Key=Value"
+// pairs intended for the forked ssh binary) that have an obvious native
+// equivalent onto cfg, without overriding anything the caller already set.
+// cfg must not be nil.
+func applyExtraSshOptions(cfg *SshConfig) {
+	for i := 0; i < len(ExtraSshOptions)-1; i++ {
+		if ExtraSshOptions[i] != "-o" {
+			continue
+		}
+
+		kv := strings.SplitN(ExtraSshOptions[i+1], "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "ConnectTimeout":
+			if cfg.Timeout == 0 {
+				if secs, err := strconv.Atoi(kv[1]); err == nil {
+					cfg.Timeout = time.Duration(secs) * time.Second
+				}
+			}
+		case "StrictHostKeyChecking":
+			if cfg.HostKeyCallback == nil && kv[1] == "no" {
+				cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+			}
+		}
+	}
+}
+
+// NewSshNative creates a CommandExecution that connects to host using
+// golang.org/x/crypto/ssh instead of forking the system ssh binary used by
+// NewSsh. args is joined with spaces and sent as the remote command, same
+// as NewSsh/prepareSshArgs does implicitly through the ssh binary.
+func NewSshNative(host string, cfg *SshConfig, args ...string) *CommandExecution {
+	if cfg != nil {
+		applyExtraSshOptions(cfg)
+	}
+
+	return &CommandExecution{
+		Command:        "ssh-native",
+		Args:           args,
+		AutoReadStdout: true,
+		AutoReadStderr: true,
+		Stdout:         "-- stdout: this command has never been executed --",
+		Stderr:         "-- stderr: this command has never been executed --",
+		ExitCode:       -1,
+		MaxStdoutBytes: defaultMaxBufferBytes,
+		MaxStderrBytes: defaultMaxBufferBytes,
+		sshHost:        host,
+		sshConfig:      cfg,
+	}
+}
+
+func (self *CommandExecution) beginNativeSsh() error {
+	cfg := self.sshConfig
+	if cfg == nil {
+		return errors.New("SshConfig is required for NewSshNative")
+	}
+
+	ctx := self.contextForExec()
+
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+
+	if cfg.HostKeyCallback == nil {
+		return errors.New("SshConfig.HostKeyCallback is required for NewSshNative")
+	}
+
+	clientCfg := &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            cfg.Auth,
+		HostKeyCallback: cfg.HostKeyCallback,
+		Timeout:         cfg.Timeout,
+	}
+
+	addr := net.JoinHostPort(self.sshHost, strconv.Itoa(port))
+
+	conn, err := (&net.Dialer{Timeout: cfg.Timeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// ssh.NewClientConn does not apply clientCfg.Timeout, so bound the
+	// handshake with a deadline on conn and clear it once connected
+	if cfg.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(cfg.Timeout))
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientCfg)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return err
+	}
+
+	if self.AutoReadStdout {
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			session.Close()
+			client.Close()
+			return err
+		}
+		self.StdoutReader = ioNopCloser{stdout}
+	}
+
+	if self.AutoReadStderr {
+		stderr, err := session.StderrPipe()
+		if err != nil {
+			session.Close()
+			client.Close()
+			return err
+		}
+		self.StderrReader = ioNopCloser{stderr}
+	}
+
+	if self.LogExecution {
+		log.Printf("DEBUG: ssh (native) \"%s@%s %s\"", cfg.User, self.sshHost, strings.Join(self.Args, " "))
+	}
+
+	self.sshClient = client
+	self.sshSession = session
+
+	return nil
+}
+
+func (self *CommandExecution) runNativeSsh() error {
+	if self.sshSession == nil {
+		if err := self.beginNativeSsh(); err != nil {
+			return err
+		}
+	}
+	if self.cancel != nil {
+		defer self.cancel()
+	}
+	defer self.sshClient.Close()
+	defer self.sshSession.Close()
+
+	remoteCmd := strings.Join(self.Args, " ")
+
+	if err := self.sshSession.Start(remoteCmd); err != nil {
+		return err
+	}
+
+	if self.ctx != nil {
+		// there is no native way to bind an ssh.Session to a context, so
+		// mirror the plain/PTY backends' SIGTERM-then-close grace period by
+		// hand: politely ask the remote command to exit, then sever the
+		// session if it hasn't by the time KillGrace elapses.
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-self.ctx.Done():
+				self.sshSession.Signal(ssh.SIGTERM)
+				select {
+				case <-time.After(self.killGraceOrDefault()):
+					self.sshSession.Close()
+				case <-done:
+				}
+			case <-done:
+			}
+		}()
+	}
+
+	if self.StdoutReader != nil {
+		if self.StdoutWriter != nil {
+			if _, err := io.Copy(self.StdoutWriter, self.StdoutReader); err != nil {
+				return err
+			}
+		} else {
+			b, truncated, err := readAllBounded(self.StdoutReader, self.MaxStdoutBytes)
+			if err != nil {
+				return err
+			}
+			self.Stdout = b
+			self.Truncated = self.Truncated || truncated
+		}
+	}
+
+	if self.StderrReader != nil {
+		if self.StderrWriter != nil {
+			if _, err := io.Copy(self.StderrWriter, self.StderrReader); err != nil {
+				return err
+			}
+		} else {
+			b, truncated, err := readAllBounded(self.StderrReader, self.MaxStderrBytes)
+			if err != nil {
+				return err
+			}
+			self.Stderr = b
+			self.Truncated = self.Truncated || truncated
+		}
+	}
+
+	err := self.sshSession.Wait()
+
+	switch cw := self.sshSession.Stdout.(type) {
+	case *CompositeWriter:
+		cw.Finalize()
+		if cw.keepBuffer {
+			self.Stdout = cw.ToString()
+			self.Truncated = self.Truncated || cw.buffer.Truncated
+			cw.buffer.Reset()
+		}
+	}
+
+	switch cw := self.sshSession.Stderr.(type) {
+	case *CompositeWriter:
+		cw.Finalize()
+		if cw.keepBuffer {
+			self.Stderr = cw.ToString()
+			self.Truncated = self.Truncated || cw.buffer.Truncated
+			cw.buffer.Reset()
+		}
+	}
+
+	if err != nil && self.ctx != nil && self.ctx.Err() != nil {
+		// canceled or timed out: distinguish this from a plain non-zero
+		// exit code by leaving ExitCode at -1 and wrapping ctx.Err()
+		self.ExitCode = -1
+		return fmt.Errorf("ssh command to '%s' did not complete: %w", self.sshHost, self.ctx.Err())
+	}
+
+	if err != nil {
+		if exiterr, ok := err.(*ssh.ExitError); ok {
+			self.ExitCode = exiterr.ExitStatus()
+			return nil
+		}
+		return err
+	}
+
+	self.ExitCode = 0
+	return nil
+}